@@ -1,33 +1,125 @@
 package util
 
 import (
-	log "github.com/sirupsen/logrus"
+	"context"
+	"errors"
 	"sync"
+	"time"
 )
 
+// ErrDisposed is returned by the context-aware BlockingQueue operations once
+// the queue has been closed, instead of blocking forever or panicking.
+var ErrDisposed = errors.New("blocking queue has been closed")
+
+// Wiring PutContext/TakeContext/Close into the producer/consumer send paths
+// (Producer.Send, the consumer ack tracker, etc.) so a canceled Send no
+// longer parks indefinitely is deferred: this checkout contains only
+// pulsar/impl/util, and the producer/consumer packages the request asks to
+// update don't exist here yet to wire up.
 type BlockingQueue interface {
-	// Enqueue one item, block if the queue is full
+	// Enqueue one item, block if the queue is full. Once the queue is
+	// closed, Put returns immediately without enqueuing the item, with no
+	// way for the caller to tell the drop happened; use PutContext if you
+	// need to detect that.
 	Put(item interface{})
 
-	// Dequeue one item, block until it's available
+	// Enqueue one item, block if the queue is full until space is available,
+	// ctx is canceled or the queue is closed
+	PutContext(ctx context.Context, item interface{}) error
+
+	// Dequeue one item, block until it's available. Once the queue is
+	// closed, Take returns a bare nil, indistinguishable from a
+	// legitimately enqueued nil item; use TakeContext if you need to
+	// detect closure reliably.
 	Take() interface{}
 
+	// Dequeue one item, block until it's available, ctx is canceled or the
+	// queue is closed
+	TakeContext(ctx context.Context) (interface{}, error)
+
+	// Dequeue one item, block until it's available or the given duration
+	// elapses. Returns false if the timeout was reached or the queue was
+	// closed before an item became available.
+	PollWithTimeout(d time.Duration) (interface{}, bool)
+
 	// Dequeue one item, return nil if queue is empty
 	Poll() interface{}
 
+	// Drain removes and returns up to max items in a single lock
+	// acquisition, in the same order Take would dequeue them (see
+	// ReadableSlice). A negative max means "all
+	// available items". Returns an empty, non-nil slice if the queue is
+	// empty.
+	Drain(max int) []interface{}
+
+	// DrainInto removes up to len(buf) items into buf, in the same order
+	// Take would dequeue them, and returns the number of items written.
+	DrainInto(buf []interface{}) int
+
+	// TakeBatch waits for at least min items to become available or for
+	// timeout to elapse, then drains and returns up to max available items.
+	// The returned batch may have fewer than min items if the timeout is
+	// reached first.
+	TakeBatch(min, max int, timeout time.Duration) []interface{}
+
 	// Return one item without dequeing, return nil if queue is empty
 	Peek() interface{}
 
 	// Return the current size of the queue
 	Size() int
 
-	// Return an iterator for the queue
-	Iterator() BlockingQueueIterator
+	// Return a copy of the queue contents, in the same order Take would
+	// dequeue them: FIFO order for NewBlockingQueue, priority order for
+	// NewPriorityBlockingQueue.
+	ReadableSlice() []interface{}
+
+	// Range iterates over the queue contents, in the same order Take would
+	// dequeue them (see ReadableSlice), calling f for each item while
+	// holding the queue lock. Iteration stops at the first call where f
+	// returns false.
+	Range(f func(item interface{}) bool)
+
+	// Close unblocks any pending PutContext/TakeContext waiters with
+	// ErrDisposed and makes every subsequent context-aware operation return
+	// ErrDisposed. The plain, non-context Put/Take are unblocked too, but
+	// can't report ErrDisposed since their signatures predate it: Put
+	// silently drops the item and Take returns a bare nil (see their doc
+	// comments above).
+	Close()
+
+	// Dispose is an alias for Close, kept for callers ported from queue
+	// implementations that expect a Dispose method.
+	Dispose()
 }
 
-type BlockingQueueIterator interface {
-	HasNext() bool
-	Next() interface{}
+// wakeGroup is a level-triggered broadcast gate used in place of sync.Cond
+// for the context-aware waits below. A caller obtains the current channel
+// while holding the queue's mutex and then waits on it, optionally in a
+// select alongside ctx.Done(): since the channel is only ever closed (never
+// sent on) and is swapped for a fresh one under the same mutex whenever the
+// condition changes, there is no gap in which a wakeup can be missed the
+// way there is between checking ctx.Err() and calling Cond.Wait() on a
+// goroutine-driven Broadcast. A close that happens concurrently with (or
+// before) the select is still observed, because a closed channel is always
+// immediately readable.
+type wakeGroup struct {
+	ch chan struct{}
+}
+
+func newWakeGroup() *wakeGroup {
+	return &wakeGroup{ch: make(chan struct{})}
+}
+
+// c returns the channel to wait on. Call while holding the queue mutex.
+func (w *wakeGroup) c() <-chan struct{} {
+	return w.ch
+}
+
+// broadcast wakes every current waiter and arms a fresh channel for the
+// next wait. Call while holding the queue mutex.
+func (w *wakeGroup) broadcast() {
+	close(w.ch)
+	w.ch = make(chan struct{})
 }
 
 type blockingQueue struct {
@@ -36,16 +128,11 @@ type blockingQueue struct {
 	tailIdx int
 	size    int
 	maxSize int
+	closed  bool
 
-	mutex      sync.Mutex
-	isNotEmpty *sync.Cond
-	isNotFull  *sync.Cond
-}
-
-type blockingQueueIterator struct {
-	bq      *blockingQueue
-	readIdx int
-	toRead  int
+	mutex    sync.Mutex
+	notEmpty *wakeGroup
+	notFull  *wakeGroup
 }
 
 func NewBlockingQueue(maxSize int) BlockingQueue {
@@ -55,45 +142,134 @@ func NewBlockingQueue(maxSize int) BlockingQueue {
 		tailIdx: 0,
 		size:    0,
 		maxSize: maxSize,
-	}
 
-	bq.isNotEmpty = sync.NewCond(&bq.mutex)
-	bq.isNotFull = sync.NewCond(&bq.mutex)
+		notEmpty: newWakeGroup(),
+		notFull:  newWakeGroup(),
+	}
 	return bq
 }
 
 func (bq *blockingQueue) Put(item interface{}) {
-	bq.mutex.Lock()
-	defer bq.mutex.Unlock()
+	for {
+		bq.mutex.Lock()
+		if bq.closed {
+			bq.mutex.Unlock()
+			return
+		}
+		if bq.size < bq.maxSize {
+			bq.enqueue(item)
+			bq.mutex.Unlock()
+			return
+		}
+
+		ch := bq.notFull.c()
+		bq.mutex.Unlock()
+		<-ch
+	}
+}
 
-	for ; bq.size == bq.maxSize; {
-		bq.isNotFull.Wait()
+func (bq *blockingQueue) PutContext(ctx context.Context, item interface{}) error {
+	for {
+		bq.mutex.Lock()
+		if bq.closed {
+			bq.mutex.Unlock()
+			return ErrDisposed
+		}
+		if bq.size < bq.maxSize {
+			bq.enqueue(item)
+			bq.mutex.Unlock()
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			bq.mutex.Unlock()
+			return err
+		}
+
+		ch := bq.notFull.c()
+		bq.mutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
+}
 
+// enqueue adds item to the tail of the queue. The caller must hold bq.mutex
+// and must have already verified there is room and the queue is not closed.
+func (bq *blockingQueue) enqueue(item interface{}) {
 	wasEmpty := bq.size == 0
 
 	bq.items[bq.tailIdx] = item
-	bq.size += 1
-	bq.tailIdx += 1
+	bq.size++
+	bq.tailIdx++
 	if bq.tailIdx >= bq.maxSize {
 		bq.tailIdx = 0
 	}
 
 	if wasEmpty {
-		// Wake up eventual reader waiting for next item
-		bq.isNotEmpty.Signal()
+		// Wake up eventual readers waiting for the next item
+		bq.notEmpty.broadcast()
 	}
 }
 
 func (bq *blockingQueue) Take() interface{} {
-	bq.mutex.Lock()
-	defer bq.mutex.Unlock()
+	for {
+		bq.mutex.Lock()
+		if bq.closed {
+			bq.mutex.Unlock()
+			return nil
+		}
+		if bq.size > 0 {
+			item := bq.dequeue()
+			bq.mutex.Unlock()
+			return item
+		}
+
+		ch := bq.notEmpty.c()
+		bq.mutex.Unlock()
+		<-ch
+	}
+}
 
-	for ; bq.size == 0; {
-		bq.isNotEmpty.Wait()
+func (bq *blockingQueue) TakeContext(ctx context.Context) (interface{}, error) {
+	for {
+		bq.mutex.Lock()
+		if bq.closed {
+			bq.mutex.Unlock()
+			return nil, ErrDisposed
+		}
+		if bq.size > 0 {
+			item := bq.dequeue()
+			bq.mutex.Unlock()
+			return item, nil
+		}
+		if err := ctx.Err(); err != nil {
+			bq.mutex.Unlock()
+			return nil, err
+		}
+
+		ch := bq.notEmpty.c()
+		bq.mutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+}
 
-	return bq.dequeue()
+func (bq *blockingQueue) PollWithTimeout(d time.Duration) (interface{}, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	item, err := bq.TakeContext(ctx)
+	if err != nil {
+		return nil, false
+	}
+	return item, true
 }
 
 func (bq *blockingQueue) Poll() interface{} {
@@ -107,6 +283,93 @@ func (bq *blockingQueue) Poll() interface{} {
 	return bq.dequeue()
 }
 
+func (bq *blockingQueue) Drain(max int) []interface{} {
+	bq.mutex.Lock()
+	defer bq.mutex.Unlock()
+
+	n := bq.size
+	if max >= 0 && max < n {
+		n = max
+	}
+
+	items := make([]interface{}, n)
+	bq.drainInto(items)
+	return items
+}
+
+func (bq *blockingQueue) DrainInto(buf []interface{}) int {
+	bq.mutex.Lock()
+	defer bq.mutex.Unlock()
+
+	return bq.drainInto(buf)
+}
+
+// drainInto removes up to len(buf) items into buf, in FIFO order, zeroing
+// the drained slots so the queue doesn't retain references. The caller must
+// hold bq.mutex. notFull is broadcast once for the whole batch rather than
+// once per item, since a batch of n items can free up to n waiters.
+func (bq *blockingQueue) drainInto(buf []interface{}) int {
+	n := bq.size
+	if n > len(buf) {
+		n = len(buf)
+	}
+	if n == 0 {
+		return 0
+	}
+
+	if bq.headIdx+n <= bq.maxSize {
+		copy(buf[:n], bq.items[bq.headIdx:bq.headIdx+n])
+		for i := bq.headIdx; i < bq.headIdx+n; i++ {
+			bq.items[i] = nil
+		}
+	} else {
+		first := bq.maxSize - bq.headIdx
+		copy(buf[:first], bq.items[bq.headIdx:])
+		copy(buf[first:n], bq.items[:n-first])
+		for i := bq.headIdx; i < bq.maxSize; i++ {
+			bq.items[i] = nil
+		}
+		for i := 0; i < n-first; i++ {
+			bq.items[i] = nil
+		}
+	}
+
+	bq.headIdx = (bq.headIdx + n) % bq.maxSize
+	bq.size -= n
+	bq.notFull.broadcast()
+
+	return n
+}
+
+func (bq *blockingQueue) TakeBatch(min, max int, timeout time.Duration) []interface{} {
+	deadline := time.Now().Add(timeout)
+
+	bq.mutex.Lock()
+	for bq.size < min && !bq.closed {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+
+		ch := bq.notEmpty.c()
+		bq.mutex.Unlock()
+		select {
+		case <-ch:
+		case <-time.After(remaining):
+		}
+		bq.mutex.Lock()
+	}
+
+	n := bq.size
+	if max >= 0 && max < n {
+		n = max
+	}
+	items := make([]interface{}, n)
+	bq.drainInto(items)
+	bq.mutex.Unlock()
+	return items
+}
+
 func (bq *blockingQueue) Peek() interface{} {
 	bq.mutex.Lock()
 	defer bq.mutex.Unlock()
@@ -122,13 +385,13 @@ func (bq *blockingQueue) dequeue() interface{} {
 	item := bq.items[bq.headIdx]
 	bq.items[bq.headIdx] = nil
 
-	bq.headIdx += 1
+	bq.headIdx++
 	if bq.headIdx == len(bq.items) {
 		bq.headIdx = 0
 	}
 
-	bq.size -= 1
-	bq.isNotFull.Signal()
+	bq.size--
+	bq.notFull.broadcast()
 	return item
 }
 
@@ -139,31 +402,53 @@ func (bq *blockingQueue) Size() int {
 	return bq.size
 }
 
-func (bq *blockingQueue) Iterator() BlockingQueueIterator {
+// ReadableSlice returns a copy of the queue contents, in FIFO order. The
+// copy is taken under the queue lock, so unlike the old index-based
+// iterator it cannot observe a concurrent Put/Poll/Take shifting headIdx
+// mid-read.
+func (bq *blockingQueue) ReadableSlice() []interface{} {
 	bq.mutex.Lock()
 	defer bq.mutex.Unlock()
 
-	return &blockingQueueIterator{
-		bq:      bq,
-		readIdx: bq.headIdx,
-		toRead:  bq.size,
+	items := make([]interface{}, bq.size)
+	if bq.size == 0 {
+		return items
 	}
-}
 
-func (bqi *blockingQueueIterator) HasNext() bool {
-	return bqi.toRead > 0
+	if bq.headIdx+bq.size <= bq.maxSize {
+		copy(items, bq.items[bq.headIdx:bq.headIdx+bq.size])
+	} else {
+		n := copy(items, bq.items[bq.headIdx:])
+		copy(items[n:], bq.items[:bq.size-n])
+	}
+	return items
 }
 
-func (bqi *blockingQueueIterator) Next() interface{} {
-	if bqi.toRead == 0 {
-		log.Panic("Trying to read past the end of the iterator")
-	}
+func (bq *blockingQueue) Range(f func(item interface{}) bool) {
+	bq.mutex.Lock()
+	defer bq.mutex.Unlock()
 
-	item := bqi.bq.items[bqi.readIdx]
-	bqi.toRead--
-	bqi.readIdx++
-	if bqi.readIdx == bqi.bq.maxSize {
-		bqi.readIdx = 0
+	idx := bq.headIdx
+	for i := 0; i < bq.size; i++ {
+		if !f(bq.items[idx]) {
+			return
+		}
+		idx++
+		if idx >= bq.maxSize {
+			idx = 0
+		}
 	}
-	return item
+}
+
+func (bq *blockingQueue) Close() {
+	bq.mutex.Lock()
+	defer bq.mutex.Unlock()
+
+	bq.closed = true
+	bq.notEmpty.broadcast()
+	bq.notFull.broadcast()
+}
+
+func (bq *blockingQueue) Dispose() {
+	bq.Close()
 }
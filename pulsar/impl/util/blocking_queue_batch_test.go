@@ -0,0 +1,82 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlockingQueueDrain(t *testing.T) {
+	q := NewBlockingQueue(8)
+	for i := 0; i < 5; i++ {
+		q.Put(i)
+	}
+
+	items := q.Drain(3)
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(items))
+	}
+	for i, item := range items {
+		if item != i {
+			t.Fatalf("expected item %d at index %d, got %v", i, i, item)
+		}
+	}
+	if q.Size() != 2 {
+		t.Fatalf("expected 2 items left, got %d", q.Size())
+	}
+
+	rest := q.Drain(-1)
+	if len(rest) != 2 || rest[0] != 3 || rest[1] != 4 {
+		t.Fatalf("unexpected remainder: %v", rest)
+	}
+}
+
+func TestBlockingQueueDrainWakesAllWaiters(t *testing.T) {
+	q := NewBlockingQueue(4)
+	for i := 0; i < 4; i++ {
+		q.Put(i)
+	}
+
+	const producers = 4
+	done := make(chan struct{}, producers)
+	for i := 0; i < producers; i++ {
+		go func(i int) {
+			q.Put(100 + i)
+			done <- struct{}{}
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	q.Drain(producers)
+
+	for i := 0; i < producers; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d/%d producers woke after Drain", i, producers)
+		}
+	}
+}
+
+func TestBlockingQueueTakeBatch(t *testing.T) {
+	q := NewBlockingQueue(8)
+	q.Put(1)
+	q.Put(2)
+
+	// Times out with fewer than min items available.
+	start := time.Now()
+	items := q.TakeBatch(5, 10, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected to wait out the timeout, returned after %v", elapsed)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items after timeout, got %d", len(items))
+	}
+
+	q.Put(3)
+	q.Put(4)
+	q.Put(5)
+	items = q.TakeBatch(1, 2, time.Second)
+	if len(items) != 2 {
+		t.Fatalf("expected max to cap the batch at 2, got %d", len(items))
+	}
+}
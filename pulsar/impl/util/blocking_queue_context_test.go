@@ -0,0 +1,92 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBlockingQueuePollWithTimeout(t *testing.T) {
+	q := NewBlockingQueue(1)
+
+	if _, ok := q.PollWithTimeout(20 * time.Millisecond); ok {
+		t.Fatal("expected timeout on empty queue")
+	}
+
+	q.Put("x")
+	item, ok := q.PollWithTimeout(20 * time.Millisecond)
+	if !ok || item != "x" {
+		t.Fatalf("expected (x, true), got (%v, %v)", item, ok)
+	}
+}
+
+func TestBlockingQueuePutContextCanceled(t *testing.T) {
+	q := NewBlockingQueue(1)
+	q.Put(1) // fill the queue
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- q.PutContext(ctx, 2) }()
+
+	// Give PutContext a chance to block before canceling.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PutContext did not return after its context was canceled")
+	}
+}
+
+func TestBlockingQueueTakeContextCanceled(t *testing.T) {
+	q := NewBlockingQueue(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := q.TakeContext(ctx)
+		errCh <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TakeContext did not return after its context was canceled")
+	}
+}
+
+func TestBlockingQueueClose(t *testing.T) {
+	q := NewBlockingQueue(1)
+
+	takeErrCh := make(chan error, 1)
+	go func() {
+		_, err := q.TakeContext(context.Background())
+		takeErrCh <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+
+	select {
+	case err := <-takeErrCh:
+		if err != ErrDisposed {
+			t.Fatalf("expected ErrDisposed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TakeContext did not return after Close")
+	}
+
+	if err := q.PutContext(context.Background(), 1); err != ErrDisposed {
+		t.Fatalf("expected ErrDisposed on closed queue, got %v", err)
+	}
+}
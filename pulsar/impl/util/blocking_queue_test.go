@@ -0,0 +1,18 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestBlockingQueuePutTakeOrder(t *testing.T) {
+	q := NewBlockingQueue(16)
+	for i := 0; i < 16; i++ {
+		q.Put(i)
+	}
+
+	for i := 0; i < 16; i++ {
+		if item := q.Take(); item != i {
+			t.Fatalf("expected %d, got %v", i, item)
+		}
+	}
+}
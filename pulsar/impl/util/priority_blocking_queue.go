@@ -0,0 +1,387 @@
+package util
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Delayed can optionally be implemented by items stored in a priority queue
+// built with NewPriorityBlockingQueue. If the head item implements Delayed,
+// Take/TakeContext/PollWithTimeout will not return it until its deadline has
+// elapsed, which is how delayed-delivery and backoff-retry items are kept
+// invisible until they're actually due.
+type Delayed interface {
+	Deadline() time.Time
+}
+
+// pqHeap adapts a plain slice plus a caller-supplied comparator to
+// container/heap.Interface.
+type pqHeap struct {
+	items []interface{}
+	less  func(a, b interface{}) bool
+}
+
+func (h *pqHeap) Len() int { return len(h.items) }
+
+func (h *pqHeap) Less(i, j int) bool { return h.less(h.items[i], h.items[j]) }
+
+func (h *pqHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *pqHeap) Push(x interface{}) { h.items = append(h.items, x) }
+
+func (h *pqHeap) Pop() interface{} {
+	old := h.items
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	h.items = old[:n-1]
+	return item
+}
+
+type priorityBlockingQueue struct {
+	heap    *pqHeap
+	maxSize int
+	closed  bool
+
+	mutex    sync.Mutex
+	notEmpty *wakeGroup
+	notFull  *wakeGroup
+}
+
+// NewPriorityBlockingQueue creates a bounded BlockingQueue backed by a binary
+// heap ordered by less, instead of FIFO order. Take always returns the
+// smallest item according to less (ties broken arbitrarily), and if that
+// item implements Delayed, Take waits until its deadline before returning
+// it. This lets delayed-delivery and retry-with-backoff paths share a single
+// queue instead of each keeping their own timer on top of a FIFO queue.
+func NewPriorityBlockingQueue(maxSize int, less func(a, b interface{}) bool) BlockingQueue {
+	return &priorityBlockingQueue{
+		heap:    &pqHeap{less: less},
+		maxSize: maxSize,
+
+		notEmpty: newWakeGroup(),
+		notFull:  newWakeGroup(),
+	}
+}
+
+func (pq *priorityBlockingQueue) Put(item interface{}) {
+	for {
+		pq.mutex.Lock()
+		if pq.closed {
+			pq.mutex.Unlock()
+			return
+		}
+		if pq.heap.Len() < pq.maxSize {
+			pq.push(item)
+			pq.mutex.Unlock()
+			return
+		}
+
+		ch := pq.notFull.c()
+		pq.mutex.Unlock()
+		<-ch
+	}
+}
+
+func (pq *priorityBlockingQueue) PutContext(ctx context.Context, item interface{}) error {
+	for {
+		pq.mutex.Lock()
+		if pq.closed {
+			pq.mutex.Unlock()
+			return ErrDisposed
+		}
+		if pq.heap.Len() < pq.maxSize {
+			pq.push(item)
+			pq.mutex.Unlock()
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			pq.mutex.Unlock()
+			return err
+		}
+
+		ch := pq.notFull.c()
+		pq.mutex.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// push inserts item into the heap and wakes waiters. The caller must hold
+// pq.mutex and must have already verified there is room and the queue is
+// not closed. Every waiter is woken (not just one) because the new item may
+// sort before the item a sleeping Take is currently waiting on the deadline
+// of, and each waiter needs the chance to re-evaluate the head.
+func (pq *priorityBlockingQueue) push(item interface{}) {
+	heap.Push(pq.heap, item)
+	pq.notEmpty.broadcast()
+}
+
+func (pq *priorityBlockingQueue) Take() interface{} {
+	for {
+		pq.mutex.Lock()
+		if pq.closed {
+			pq.mutex.Unlock()
+			return nil
+		}
+		if pq.heap.Len() == 0 {
+			ch := pq.notEmpty.c()
+			pq.mutex.Unlock()
+			<-ch
+			continue
+		}
+
+		if wait := pq.headWait(); wait > 0 {
+			ch := pq.notEmpty.c()
+			pq.mutex.Unlock()
+			select {
+			case <-ch:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		item := heap.Pop(pq.heap)
+		pq.notFull.broadcast()
+		pq.mutex.Unlock()
+		return item
+	}
+}
+
+func (pq *priorityBlockingQueue) TakeContext(ctx context.Context) (interface{}, error) {
+	for {
+		pq.mutex.Lock()
+		if pq.closed {
+			pq.mutex.Unlock()
+			return nil, ErrDisposed
+		}
+		if pq.heap.Len() == 0 {
+			if err := ctx.Err(); err != nil {
+				pq.mutex.Unlock()
+				return nil, err
+			}
+
+			ch := pq.notEmpty.c()
+			pq.mutex.Unlock()
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			pq.mutex.Unlock()
+			return nil, err
+		}
+
+		if wait := pq.headWait(); wait > 0 {
+			ch := pq.notEmpty.c()
+			pq.mutex.Unlock()
+			select {
+			case <-ch:
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		item := heap.Pop(pq.heap)
+		pq.notFull.broadcast()
+		pq.mutex.Unlock()
+		return item, nil
+	}
+}
+
+func (pq *priorityBlockingQueue) PollWithTimeout(d time.Duration) (interface{}, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	item, err := pq.TakeContext(ctx)
+	if err != nil {
+		return nil, false
+	}
+	return item, true
+}
+
+// headWait returns how long the caller should wait before the head item
+// becomes due, or zero/negative if it's ready to be popped now. The caller
+// must hold pq.mutex and must have already verified the heap is non-empty.
+func (pq *priorityBlockingQueue) headWait() time.Duration {
+	head := pq.heap.items[0]
+	d, ok := head.(Delayed)
+	if !ok {
+		return 0
+	}
+	return time.Until(d.Deadline())
+}
+
+func (pq *priorityBlockingQueue) Drain(max int) []interface{} {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	limit := pq.heap.Len()
+	if max >= 0 && max < limit {
+		limit = max
+	}
+
+	items := pq.drainUpTo(limit)
+	if len(items) > 0 {
+		// Broadcast, not Signal: up to len(items) waiters may now have room
+		// to proceed, not just one.
+		pq.notFull.broadcast()
+	}
+	return items
+}
+
+func (pq *priorityBlockingQueue) DrainInto(buf []interface{}) int {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	limit := pq.heap.Len()
+	if limit > len(buf) {
+		limit = len(buf)
+	}
+
+	items := pq.drainUpTo(limit)
+	copy(buf, items)
+	if len(items) > 0 {
+		pq.notFull.broadcast()
+	}
+	return len(items)
+}
+
+// drainUpTo pops up to limit items off the heap, in priority order, stopping
+// early if the new head implements Delayed and isn't due yet. The caller
+// must hold pq.mutex and is responsible for broadcasting notFull.
+func (pq *priorityBlockingQueue) drainUpTo(limit int) []interface{} {
+	items := make([]interface{}, 0, limit)
+	for len(items) < limit {
+		head := pq.heap.items[0]
+		if d, ok := head.(Delayed); ok && d.Deadline().After(time.Now()) {
+			break
+		}
+		items = append(items, heap.Pop(pq.heap))
+	}
+	return items
+}
+
+func (pq *priorityBlockingQueue) TakeBatch(min, max int, timeout time.Duration) []interface{} {
+	deadline := time.Now().Add(timeout)
+
+	pq.mutex.Lock()
+	for pq.heap.Len() < min && !pq.closed {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+
+		ch := pq.notEmpty.c()
+		pq.mutex.Unlock()
+		select {
+		case <-ch:
+		case <-time.After(remaining):
+		}
+		pq.mutex.Lock()
+	}
+
+	limit := pq.heap.Len()
+	if max >= 0 && max < limit {
+		limit = max
+	}
+	items := pq.drainUpTo(limit)
+	if len(items) > 0 {
+		pq.notFull.broadcast()
+	}
+	pq.mutex.Unlock()
+	return items
+}
+
+func (pq *priorityBlockingQueue) Poll() interface{} {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if pq.heap.Len() == 0 {
+		return nil
+	}
+
+	head := pq.heap.items[0]
+	if d, ok := head.(Delayed); ok && d.Deadline().After(time.Now()) {
+		return nil
+	}
+
+	item := heap.Pop(pq.heap)
+	pq.notFull.broadcast()
+	return item
+}
+
+func (pq *priorityBlockingQueue) Peek() interface{} {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	if pq.heap.Len() == 0 {
+		return nil
+	}
+	return pq.heap.items[0]
+}
+
+func (pq *priorityBlockingQueue) Size() int {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	return pq.heap.Len()
+}
+
+// ReadableSlice returns a copy of the queue contents sorted in priority
+// order (the order Take would dequeue them in), not the underlying heap's
+// internal array order.
+func (pq *priorityBlockingQueue) ReadableSlice() []interface{} {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	return pq.sortedCopyLocked()
+}
+
+// Range iterates over the queue contents in priority order (see
+// ReadableSlice), calling f for each item while holding the queue lock.
+func (pq *priorityBlockingQueue) Range(f func(item interface{}) bool) {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	for _, item := range pq.sortedCopyLocked() {
+		if !f(item) {
+			return
+		}
+	}
+}
+
+// sortedCopyLocked returns a copy of the heap contents sorted by pq.heap.less,
+// leaving the heap itself untouched. The caller must hold pq.mutex.
+func (pq *priorityBlockingQueue) sortedCopyLocked() []interface{} {
+	items := make([]interface{}, len(pq.heap.items))
+	copy(items, pq.heap.items)
+	sort.Slice(items, func(i, j int) bool { return pq.heap.less(items[i], items[j]) })
+	return items
+}
+
+func (pq *priorityBlockingQueue) Close() {
+	pq.mutex.Lock()
+	defer pq.mutex.Unlock()
+
+	pq.closed = true
+	pq.notEmpty.broadcast()
+	pq.notFull.broadcast()
+}
+
+func (pq *priorityBlockingQueue) Dispose() {
+	pq.Close()
+}
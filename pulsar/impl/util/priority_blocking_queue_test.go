@@ -0,0 +1,134 @@
+// Tests for NewPriorityBlockingQueue. The PutContext/TakeContext/Close and
+// Drain/TakeBatch tests for NewBlockingQueue are in
+// blocking_queue_context_test.go and blocking_queue_batch_test.go.
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+type delayedItem struct {
+	id       int
+	deadline time.Time
+}
+
+func (d delayedItem) Deadline() time.Time { return d.deadline }
+
+func lessDelayed(a, b interface{}) bool {
+	return a.(delayedItem).deadline.Before(b.(delayedItem).deadline)
+}
+
+func lessInt(a, b interface{}) bool {
+	return a.(int) < b.(int)
+}
+
+func TestPriorityBlockingQueueOrder(t *testing.T) {
+	q := NewPriorityBlockingQueue(8, lessInt)
+	for _, v := range []int{5, 1, 4, 2, 3} {
+		q.Put(v)
+	}
+
+	for i := 1; i <= 5; i++ {
+		if item := q.Take(); item != i {
+			t.Fatalf("expected %d, got %v", i, item)
+		}
+	}
+}
+
+// TestPriorityBlockingQueueNewItemPreemptsSleepingTake covers the case the
+// request called out explicitly: a Take() sleeping until a far-off head
+// deadline must wake up promptly when a new, earlier-due item is pushed,
+// rather than sleeping through to the original deadline.
+func TestPriorityBlockingQueueNewItemPreemptsSleepingTake(t *testing.T) {
+	q := NewPriorityBlockingQueue(8, lessDelayed)
+	q.Put(delayedItem{id: 1, deadline: time.Now().Add(500 * time.Millisecond)})
+
+	resultCh := make(chan interface{}, 1)
+	go func() {
+		resultCh <- q.Take()
+	}()
+
+	// Let Take observe the heap and start sleeping on item 1's deadline.
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	q.Put(delayedItem{id: 2, deadline: time.Now()})
+
+	select {
+	case item := <-resultCh:
+		if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+			t.Fatalf("Take took %v to wake after a preempting item was pushed, "+
+				"want well under the original 500ms deadline", elapsed)
+		}
+		if got := item.(delayedItem).id; got != 2 {
+			t.Fatalf("expected the preempting item (id 2) to be taken first, got id %d", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Take did not wake up when a preempting item was pushed")
+	}
+}
+
+func TestPriorityBlockingQueueClose(t *testing.T) {
+	q := NewPriorityBlockingQueue(1, lessInt)
+
+	takeCh := make(chan interface{}, 1)
+	go func() { takeCh <- q.Take() }()
+
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+
+	select {
+	case item := <-takeCh:
+		if item != nil {
+			t.Fatalf("expected nil from Take on closed queue, got %v", item)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Take did not return after Close")
+	}
+}
+
+func TestPriorityBlockingQueueDrain(t *testing.T) {
+	q := NewPriorityBlockingQueue(8, lessInt)
+	for _, v := range []int{3, 1, 2} {
+		q.Put(v)
+	}
+
+	items := q.Drain(2)
+	if len(items) != 2 || items[0] != 1 || items[1] != 2 {
+		t.Fatalf("expected [1 2], got %v", items)
+	}
+	if q.Size() != 1 {
+		t.Fatalf("expected 1 item left, got %d", q.Size())
+	}
+}
+
+func TestPriorityBlockingQueueTakeBatch(t *testing.T) {
+	q := NewPriorityBlockingQueue(8, lessInt)
+	q.Put(1)
+	q.Put(2)
+
+	start := time.Now()
+	items := q.TakeBatch(5, 10, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected to wait out the timeout, returned after %v", elapsed)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items after timeout, got %d", len(items))
+	}
+}
+
+func benchmarkPutTake(b *testing.B, q BlockingQueue) {
+	for i := 0; i < b.N; i++ {
+		q.Put(i)
+		q.Take()
+	}
+}
+
+func BenchmarkBlockingQueuePutTake(b *testing.B) {
+	benchmarkPutTake(b, NewBlockingQueue(1024))
+}
+
+func BenchmarkPriorityBlockingQueuePutTake(b *testing.B) {
+	benchmarkPutTake(b, NewPriorityBlockingQueue(1024, lessInt))
+}